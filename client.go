@@ -2,7 +2,9 @@ package apns
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -22,6 +24,11 @@ var (
 type SendErr struct {
 	Pn  *PushNotification
 	Res *errResponse
+	// Err carries the underlying error for producers that have one but
+	// no errResponse to report, such as an HTTP2Client transport failure
+	// or provider-token refresh error. Client's own failed writes leave
+	// it nil.
+	Err error
 }
 
 // Client contains the fields necessary to communicate
@@ -41,18 +48,37 @@ type Client struct {
 	CertificateBase64 string
 	KeyFile           string
 	KeyBase64         string
-	certificate       tls.Certificate
-	apnsConnection    *tls.Conn
-	errChan           chan *errResponse
-	sentQ             *pnQueue
-	counter           int32
-	running           bool
+
+	// MaxSendQ, TimeOut and ErrChanCap default to the package-level
+	// MAX_SEND_Q, TIME_OUT and 10, but can be set per Client (see
+	// NewClientWithOptions and NewClientPoolWithOptions) so that a Pool
+	// can tune its workers independently of other clients in the
+	// process.
+	MaxSendQ   int
+	TimeOut    time.Duration
+	ErrChanCap int
+
+	// RootCAs overrides the system trust store used to verify the
+	// gateway's certificate. It is nil (system trust) for real use
+	// against Apple, and set to a pool containing a TestServer's
+	// certificate in tests.
+	RootCAs *x509.CertPool
+
+	certificate    tls.Certificate
+	apnsConnection *tls.Conn
+	errChan        chan *errResponse
+	sentQ          *pnQueue
+	counter        int32
+	counterBound   int32 // counter wraps modulo this; IdentifierUbound unless part of a Pool
+	workerIdent    int32 // OR'd into every Identifier; set by NewClientPool
+	store          Store
+	running        bool
 }
 
 // BareClient can be used to set the contents of your
 // certificate and key blocks manually.
 func BareClient(gateway, certificateBase64, keyBase64 string) (c *Client) {
-	c = create(gateway)
+	c = create(gateway, MAX_SEND_Q, TIME_OUT, 10, noopStore{})
 	c.CertificateBase64 = certificateBase64
 	c.KeyBase64 = keyBase64
 	return
@@ -61,17 +87,57 @@ func BareClient(gateway, certificateBase64, keyBase64 string) (c *Client) {
 // NewClient assumes you'll be passing in paths that
 // point to your certificate and key.
 func NewClient(gateway, certificateFile, keyFile string) (c *Client) {
-	c = create(gateway)
+	c = create(gateway, MAX_SEND_Q, TIME_OUT, 10, noopStore{})
 	c.CertificateFile = certificateFile
 	c.KeyFile = keyFile
 	return
 }
 
-func create(gateway string) (c *Client) {
+// NewClientWithOptions is like NewClient, but lets the caller tune
+// MaxSendQ, TimeOut and ErrChanCap for this Client alone, independently
+// of the package-level MAX_SEND_Q/TIME_OUT defaults and of any other
+// Client or Pool in the same process.
+func NewClientWithOptions(gateway, certificateFile, keyFile string, maxSendQ int, timeOut time.Duration, errChanCap int) (c *Client) {
+	c = create(gateway, maxSendQ, timeOut, errChanCap, noopStore{})
+	c.CertificateFile = certificateFile
+	c.KeyFile = keyFile
+	return
+}
+
+// NewClientWithStore is like NewClient, but every notification is
+// recorded in store before it is written to Apple; if store.Enqueue
+// fails, the error is logged and the notification is still written. On startup
+// it replays whatever store.LoadUnacked returns through Send before
+// returning, so a notification enqueued just before a crash is not
+// silently lost.
+func NewClientWithStore(gateway, certificateFile, keyFile string, store Store) (c *Client, err error) {
+	c = create(gateway, MAX_SEND_Q, TIME_OUT, 10, store)
+	c.CertificateFile = certificateFile
+	c.KeyFile = keyFile
+
+	unacked, err := store.LoadUnacked()
+	if err != nil {
+		return nil, err
+	}
+	for _, pn := range unacked {
+		if err := c.Send(pn); err != nil {
+			log.Println("replay err", err, pn.Identifier)
+		}
+	}
+
+	return c, nil
+}
+
+func create(gateway string, maxSendQ int, timeOut time.Duration, errChanCap int, store Store) (c *Client) {
 	c = new(Client)
 	c.Gateway = gateway
-	c.errChan = make(chan *errResponse, 10)
-	c.sentQ = newPnQueue(MAX_SEND_Q)
+	c.MaxSendQ = maxSendQ
+	c.TimeOut = timeOut
+	c.ErrChanCap = errChanCap
+	c.errChan = make(chan *errResponse, errChanCap)
+	c.sentQ = newPnQueue(maxSendQ)
+	c.store = store
+	c.counterBound = IdentifierUbound
 	c.running = true
 
 	go func() {
@@ -100,10 +166,20 @@ func (client *Client) handleErrResponse(res *errResponse) {
 	log.Printf("handle err response %d, %##v\n", res.Identifier, errPn)
 
 	if errPn == nil {
-		log.Println("[warn] MAX_SEND_Q is too short:", MAX_SEND_Q)
+		log.Println("[warn] MaxSendQ is too short:", client.MaxSendQ)
 		return
 	}
 
+	// res.Identifier == 0 means Apple is erroring on the very first
+	// notification this client ever sent: there is nothing before it to
+	// ack, and res.Identifier-1 would underflow to the largest uint64 and
+	// wipe the whole unacked set once passed to AckThrough.
+	if res.Identifier != 0 {
+		if err := client.store.AckThrough(uint64(res.Identifier - 1)); err != nil {
+			log.Println("store ack err", err)
+		}
+	}
+
 	go func() {
 		ErrChannel <- &SendErr{Pn: errPn, Res: res}
 	}()
@@ -111,6 +187,8 @@ func (client *Client) handleErrResponse(res *errResponse) {
 	client.sentQ.Clear()
 
 	if len(reSend) > 0 {
+		// re-Send durably re-enqueues each notification in the tail,
+		// since client.store.Enqueue runs inside Send itself.
 		go func(l []*PushNotification) {
 			for _, pn := range l {
 				if err := client.Send(pn); err != nil {
@@ -123,7 +201,16 @@ func (client *Client) handleErrResponse(res *errResponse) {
 
 // Send connects to the APN service and sends your push notification.
 // Remember that if the submission is successful, Apple won't reply.
+//
+// It is a thin wrapper around SendContext using context.Background(),
+// kept for backward compatibility.
 func (client *Client) Send(pn *PushNotification) error {
+	return client.SendContext(context.Background(), pn)
+}
+
+// SendContext is like Send, but the dial, handshake and write all abort
+// as soon as ctx is done rather than running until client.TimeOut elapses.
+func (client *Client) SendContext(ctx context.Context, pn *PushNotification) error {
 	client.Lock()
 	defer client.Unlock()
 
@@ -131,15 +218,19 @@ func (client *Client) Send(pn *PushNotification) error {
 		return fmt.Errorf("client is not running")
 	}
 
-	pn.Identifier = client.counter
-	client.counter = (client.counter + 1) % IdentifierUbound
+	pn.Identifier = client.workerIdent | client.counter
+	client.counter = (client.counter + 1) % client.counterBound
+
+	if _, err := client.store.Enqueue(pn); err != nil {
+		log.Println("store enqueue err", err, pn.Identifier)
+	}
 
 	payload, err := pn.ToBytes()
 	if err != nil {
 		return err
 	}
 
-	err = client.connectAndWrite(payload)
+	err = client.connectAndWrite(ctx, payload)
 	if err == nil {
 		client.sentQ.Append(pn)
 	} else {
@@ -152,7 +243,15 @@ func (client *Client) Send(pn *PushNotification) error {
 	return err
 }
 
+// Connect is a thin wrapper around ConnectContext using
+// context.Background(), kept for backward compatibility.
 func (client *Client) Connect() error {
+	return client.ConnectContext(context.Background())
+}
+
+// ConnectContext is like Connect, but the dial and handshake abort as
+// soon as ctx is done.
+func (client *Client) ConnectContext(ctx context.Context) error {
 	client.Lock()
 	defer client.Unlock()
 
@@ -161,34 +260,23 @@ func (client *Client) Connect() error {
 	}
 
 	if client.apnsConnection == nil {
-		return client.openConnection()
+		return client.openConnection(ctx)
 	}
 	return nil
 }
 
-// ConnectAndWrite establishes the connection to Apple and handles the
-// transmission of your push notification, as well as waiting for a reply.
-//
-// In lieu of a timeout (which would be available in Go 1.1)
-// we use a timeout channel pattern instead. We start two goroutines,
-// one of which just sleeps for TimeoutSeconds seconds, while the other
-// waits for a response from the Apple servers.
-//
-// Whichever channel puts data on first is the "winner". As such, it's
-// possible to get a false positive if Apple takes a long time to respond.
-// It's probably not a deal-breaker, but something to be aware of.
-func (client *Client) connectAndWrite(payload []byte) error {
+// connectAndWrite establishes the connection to Apple if needed and
+// writes the payload, reconnecting once and retrying on a write error.
+// The write is bounded by client.TimeOut and by ctx, whichever is sooner;
+// cancelling ctx aborts an in-flight write.
+func (client *Client) connectAndWrite(ctx context.Context, payload []byte) error {
 	if client.apnsConnection == nil {
-		if err := client.openConnection(); err != nil {
+		if err := client.openConnection(ctx); err != nil {
 			return err
 		}
 	}
 
-	if err := client.apnsConnection.SetWriteDeadline(time.Now().Add(TIME_OUT)); err != nil {
-		return err
-	}
-	_, err := client.apnsConnection.Write(payload)
-	if err != nil {
+	if err := client.writeWithDeadline(ctx, payload); err != nil {
 		log.Println("write error ", err, "try again")
 		//		if err != io.EOF && err.Error() != "use of closed network connection" && err != syscall.EPIPE {
 		//			return err
@@ -196,24 +284,46 @@ func (client *Client) connectAndWrite(payload []byte) error {
 		//		log.Println("try again")
 
 		// If the connection is closed, reconnect
-		if err := client.openConnection(); err != nil {
+		if err := client.openConnection(ctx); err != nil {
 			return err
 		}
 
-		if err := client.apnsConnection.SetWriteDeadline(time.Now().Add(TIME_OUT)); err != nil {
-			return err
-		}
-		if _, err := client.apnsConnection.Write(payload); err != nil {
-			return err
-		}
+		return client.writeWithDeadline(ctx, payload)
 	}
+	return nil
+}
+
+// writeWithDeadline writes payload to the current connection, bounding
+// the write by whichever comes first: client.TimeOut, or ctx's own deadline.
+// If ctx is cancelled while the write is in flight, it is aborted by
+// forcing the write deadline to the past.
+func (client *Client) writeWithDeadline(ctx context.Context, payload []byte) error {
+	deadline := time.Now().Add(client.TimeOut)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	if err := client.apnsConnection.SetWriteDeadline(deadline); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			client.apnsConnection.SetWriteDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	_, err := client.apnsConnection.Write(payload)
 	return err
 }
 
 // Opens a connection to the Apple APNS server
 // The connection is created and persisted to the client's apnsConnection property
 //	to save on the overhead of the crypto libraries.
-func (client *Client) openConnection() error {
+func (client *Client) openConnection(ctx context.Context) error {
 	log.Printf("open connection %p\n", client)
 	err := client.getCertificate()
 	if err != nil {
@@ -225,17 +335,20 @@ func (client *Client) openConnection() error {
 		Certificates: []tls.Certificate{client.certificate},
 		ServerName:   strings.Split(client.Gateway, ":")[0],
 		MinVersion:   tls.VersionTLS10,
+		RootCAs:      client.RootCAs,
 	}
 
-	conn, err := net.DialTimeout("tcp", client.Gateway, TIME_OUT)
+	dialCtx, cancel := context.WithTimeout(ctx, client.TimeOut)
+	defer cancel()
+
+	conn, err := (&net.Dialer{}).DialContext(dialCtx, "tcp", client.Gateway)
 	if err != nil {
 		log.Println("open connection err", err)
 		return err
 	}
 
 	tlsConn := tls.Client(conn, conf)
-	err = tlsConn.Handshake()
-	if err != nil {
+	if err := tlsConn.HandshakeContext(dialCtx); err != nil {
 		log.Println("tls handshake err", err)
 		return err
 	}
@@ -302,9 +415,29 @@ func startRead(client *Client, conn *tls.Conn) {
 
 	log.Printf("get err response : %##v, %s\n", errRsp, errMsg)
 
+	// Apple (and TestServer) close the connection right after writing an
+	// error response, so this connection is already dead on the peer
+	// side even though our own Read succeeded. Reset it the same way the
+	// error path above does, otherwise the next Send can write to a
+	// socket the peer has already closed and lose the notification to a
+	// TCP write-before-RST race instead of reconnecting.
+	conn.Close()
+	go client.tryReset(conn)
 	go client.saveErr(errRsp)
 }
 
+// loadCertificate loads a certificate from certFile/keyFile, or from
+// certBase64/keyBase64 if either of those is set, so that Client,
+// FeedbackClient and HTTP2Client can all load credentials the same way.
+func loadCertificate(certFile, certBase64, keyFile, keyBase64 string) (tls.Certificate, error) {
+	if len(certBase64) == 0 && len(keyBase64) == 0 {
+		// The user did not specify raw block contents, so check the filesystem.
+		return tls.LoadX509KeyPair(certFile, keyFile)
+	}
+	// The user provided the raw block contents, so use that.
+	return tls.X509KeyPair([]byte(certBase64), []byte(keyBase64))
+}
+
 // Returns a certificate to use to send the notification.
 // The certificate is only created once to save on
 // the overhead of the crypto libraries.
@@ -312,13 +445,7 @@ func (client *Client) getCertificate() error {
 	var err error
 
 	if client.certificate.PrivateKey == nil {
-		if len(client.CertificateBase64) == 0 && len(client.KeyBase64) == 0 {
-			// The user did not specify raw block contents, so check the filesystem.
-			client.certificate, err = tls.LoadX509KeyPair(client.CertificateFile, client.KeyFile)
-		} else {
-			// The user provided the raw block contents, so use that.
-			client.certificate, err = tls.X509KeyPair([]byte(client.CertificateBase64), []byte(client.KeyBase64))
-		}
+		client.certificate, err = loadCertificate(client.CertificateFile, client.CertificateBase64, client.KeyFile, client.KeyBase64)
 	}
 
 	return err
@@ -0,0 +1,114 @@
+package apns
+
+import (
+	"testing"
+	"time"
+)
+
+var _ PushClient = (*MockClient)(nil)
+
+func TestMockClientRecordsSendsAndCannedErrors(t *testing.T) {
+	m := NewMockClient()
+
+	pn := &PushNotification{DeviceToken: "abcd"}
+	if err := m.Send(pn); err != nil {
+		t.Fatalf("Send returned %v, want nil", err)
+	}
+	if got := m.SentCount(); got != 1 {
+		t.Fatalf("SentCount() = %d, want 1", got)
+	}
+	if m.Sent[0] != pn {
+		t.Fatalf("Sent[0] = %v, want %v", m.Sent[0], pn)
+	}
+
+	m.SendErr = errTest
+	if err := m.Send(pn); err != errTest {
+		t.Fatalf("Send returned %v, want errTest", err)
+	}
+
+	go m.DeliverErr(pn, &errResponse{Command: ERR_RESPONSE_CMD, Status: 8, Identifier: pn.Identifier})
+	select {
+	case sendErr := <-ErrChannel:
+		if sendErr.Pn != pn {
+			t.Fatalf("ErrChannel delivered Pn %v, want %v", sendErr.Pn, pn)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for DeliverErr on ErrChannel")
+	}
+
+	m.Close()
+	if !m.Closed {
+		t.Fatal("Close() did not mark MockClient as closed")
+	}
+}
+
+// errTest is a sentinel so MockClient.SendErr can be compared with ==.
+var errTest = &testError{"mock send failure"}
+
+type testError struct{ msg string }
+
+func (e *testError) Error() string { return e.msg }
+
+func TestClientResendsAfterErrorResponse(t *testing.T) {
+	server, err := NewTestServer()
+	if err != nil {
+		t.Fatalf("NewTestServer() err = %v", err)
+	}
+	defer server.Close()
+
+	// Fail the second notification (index 1) received on a connection,
+	// which drives Client's sentQ.Tail/handleErrResponse path. Nothing is
+	// sent after it before the error arrives, so the re-send tail is
+	// empty; the test then checks that Client sends again afterwards.
+	server.FailAt(1, 8, 1)
+
+	clientCert, _, err := generateSelfSignedCert()
+	if err != nil {
+		t.Fatalf("generateSelfSignedCert() err = %v", err)
+	}
+
+	client := NewClient(server.Addr, "", "")
+	client.RootCAs = server.CertPool()
+	client.certificate = clientCert
+	defer client.Close()
+
+	// Send the two notifications that make up the connection TestServer
+	// will fail on (it replies to the second one, index 1, then closes),
+	// then wait on ErrChannel rather than the wall clock: that channel
+	// only receives once handleErrResponse has actually run, and by then
+	// startRead has already closed the failed connection on Client's side.
+	for i := 0; i < 2; i++ {
+		pn := &PushNotification{DeviceToken: "abcd"}
+		if err := client.Send(pn); err != nil {
+			t.Fatalf("Send(%d) err = %v", i, err)
+		}
+	}
+
+	select {
+	case <-ErrChannel:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the simulated error response on ErrChannel")
+	}
+
+	// Now that handleErrResponse has run, the old connection is closed
+	// locally, so this Send dials a fresh connection (either because
+	// tryReset has cleared apnsConnection, or because the write on the
+	// closed connection fails and connectAndWrite reconnects) rather than
+	// race a write against the peer's already-closed socket.
+	pn := &PushNotification{DeviceToken: "abcd"}
+	if err := client.Send(pn); err != nil {
+		t.Fatalf("Send(2) err = %v", err)
+	}
+
+	deadline := time.After(2 * time.Second)
+	for {
+		if len(server.Received()) >= 3 {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("server saw %d frames, want at least 3 (two original sends plus the send after the error)", len(server.Received()))
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
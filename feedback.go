@@ -0,0 +1,182 @@
+package apns
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// feedbackTupleHeaderLen is the length, in bytes, of the fixed header of
+// a single record in the feedback stream: a 4-byte timestamp and a 2-byte
+// token length. The token itself follows the header (32 bytes for the
+// device tokens Apple issues today).
+const feedbackTupleHeaderLen = 6
+
+// FeedbackTuple represents a single entry returned by the feedback
+// service: a device token that Apple considers permanently invalid, and
+// the time at which it was last seen to fail delivery.
+type FeedbackTuple struct {
+	Timestamp   time.Time
+	DeviceToken string
+}
+
+// FeedbackClient talks to Apple's feedback service, which reports device
+// tokens that should be pruned because the app has been uninstalled or
+// the token has otherwise gone stale. Unlike Client, it is not meant to
+// be kept open indefinitely: connect, drain FeedbackChannel until it
+// closes, then Shutdown.
+type FeedbackClient struct {
+	Gateway           string
+	CertificateFile   string
+	CertificateBase64 string
+	KeyFile           string
+	KeyBase64         string
+	certificate       tls.Certificate
+
+	FeedbackChannel chan *FeedbackTuple
+	ErrChannel      chan error
+
+	conn     *tls.Conn
+	shutdown chan struct{}
+}
+
+// BareFeedbackClient can be used to set the contents of your certificate
+// and key blocks manually.
+func BareFeedbackClient(gateway, certificateBase64, keyBase64 string) (c *FeedbackClient) {
+	c = createFeedbackClient(gateway)
+	c.CertificateBase64 = certificateBase64
+	c.KeyBase64 = keyBase64
+	return
+}
+
+// NewFeedbackClient assumes you'll be passing in paths that point to
+// your certificate and key.
+func NewFeedbackClient(gateway, certificateFile, keyFile string) (c *FeedbackClient) {
+	c = createFeedbackClient(gateway)
+	c.CertificateFile = certificateFile
+	c.KeyFile = keyFile
+	return
+}
+
+func createFeedbackClient(gateway string) (c *FeedbackClient) {
+	c = new(FeedbackClient)
+	c.Gateway = gateway
+	c.FeedbackChannel = make(chan *FeedbackTuple)
+	c.ErrChannel = make(chan error, 1)
+	c.shutdown = make(chan struct{})
+	return
+}
+
+// getCertificate returns a certificate to use when dialing the feedback
+// service. The certificate is only loaded once to save on the overhead
+// of the crypto libraries.
+func (client *FeedbackClient) getCertificate() error {
+	var err error
+
+	if client.certificate.PrivateKey == nil {
+		client.certificate, err = loadCertificate(client.CertificateFile, client.CertificateBase64, client.KeyFile, client.KeyBase64)
+	}
+
+	return err
+}
+
+// Receive dials the feedback service and starts a goroutine that streams
+// FeedbackTuple values on FeedbackChannel until Apple closes the
+// connection or Shutdown is called. Receive itself returns as soon as the
+// connection is established; callers should then range over
+// FeedbackChannel to consume tuples and prune them from their own device
+// token store.
+func (client *FeedbackClient) Receive() error {
+	if err := client.getCertificate(); err != nil {
+		log.Println("feedback cert err", err)
+		return err
+	}
+
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{client.certificate},
+		ServerName:   strings.Split(client.Gateway, ":")[0],
+		MinVersion:   tls.VersionTLS10,
+	}
+
+	conn, err := net.DialTimeout("tcp", client.Gateway, TIME_OUT)
+	if err != nil {
+		log.Println("feedback dial err", err)
+		return err
+	}
+
+	tlsConn := tls.Client(conn, conf)
+	if err := tlsConn.Handshake(); err != nil {
+		log.Println("feedback tls handshake err", err)
+		return err
+	}
+	client.conn = tlsConn
+
+	go client.readLoop(tlsConn)
+	return nil
+}
+
+func (client *FeedbackClient) readLoop(conn *tls.Conn) {
+	defer close(client.FeedbackChannel)
+	defer conn.Close()
+
+	header := make([]byte, feedbackTupleHeaderLen)
+
+	for {
+		select {
+		case <-client.shutdown:
+			return
+		default:
+		}
+
+		if _, err := io.ReadFull(conn, header); err != nil {
+			if err != io.EOF && !client.shuttingDown() {
+				client.ErrChannel <- err
+			}
+			return
+		}
+
+		var timestamp uint32
+		var tokenLen uint16
+		timestamp = binary.BigEndian.Uint32(header[0:4])
+		tokenLen = binary.BigEndian.Uint16(header[4:6])
+
+		token := make([]byte, tokenLen)
+		if _, err := io.ReadFull(conn, token); err != nil {
+			if !client.shuttingDown() {
+				client.ErrChannel <- err
+			}
+			return
+		}
+
+		client.FeedbackChannel <- &FeedbackTuple{
+			Timestamp:   time.Unix(int64(timestamp), 0),
+			DeviceToken: hex.EncodeToString(token),
+		}
+	}
+}
+
+// Shutdown closes the underlying connection, ending Receive's read loop.
+func (client *FeedbackClient) Shutdown() {
+	close(client.shutdown)
+	if client.conn != nil {
+		client.conn.Close()
+	}
+}
+
+// shuttingDown reports whether Shutdown has been called, so readLoop can
+// tell a clean shutdown (conn.Close unblocking its own read) apart from
+// a genuine read error. client.shutdown is only ever closed, never sent
+// on, so this is a non-blocking, race-free check.
+func (client *FeedbackClient) shuttingDown() bool {
+	select {
+	case <-client.shutdown:
+		return true
+	default:
+		return false
+	}
+}
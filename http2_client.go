@@ -0,0 +1,366 @@
+package apns
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// jwtRefreshInterval is comfortably inside Apple's one-hour token expiry,
+// so a long-lived HTTP2Client never has a request rejected for an
+// expired provider token.
+const jwtRefreshInterval = 50 * time.Minute
+
+// HTTP2Client speaks Apple's JSON+HTTP/2 provider API, the replacement
+// for the legacy binary interface used by Client. It supports the same
+// two authentication schemes Apple offers: TLS client certificates (via
+// loadCertificate, shared with Client) or a JWT provider token signed
+// with an ES256 .p8 key.
+type HTTP2Client struct {
+	Gateway           string
+	CertificateFile   string
+	CertificateBase64 string
+	KeyFile           string
+	KeyBase64         string
+	certificate       tls.Certificate
+
+	// KeyID and TeamID identify the signing key and developer team when
+	// authenticating with a provider token instead of a certificate.
+	KeyID  string
+	TeamID string
+
+	// Topic, CollapseID and PushType set the corresponding `apns-*`
+	// headers on every notification sent through this client.
+	Topic      string
+	CollapseID string
+	PushType   string
+
+	httpClient *http.Client
+
+	mu          sync.RWMutex
+	signingKey  *ecdsa.PrivateKey
+	token       string
+	tokenIssued time.Time
+	stop        chan struct{}
+}
+
+// HTTP2Response is the typed result of a single provider API request,
+// translating the `:status` header and JSON `reason` body Apple returns.
+type HTTP2Response struct {
+	StatusCode int
+	ApnsID     string
+	Reason     string
+}
+
+// Success reports whether Apple accepted the notification for delivery.
+func (r *HTTP2Response) Success() bool {
+	return r.StatusCode == http.StatusOK
+}
+
+// Known `reason` values from Apple's provider API documentation.
+const (
+	ReasonBadDeviceToken       = "BadDeviceToken"
+	ReasonUnregistered         = "Unregistered"
+	ReasonPayloadTooLarge      = "PayloadTooLarge"
+	ReasonMissingTopic         = "MissingTopic"
+	ReasonTopicDisallowed      = "TopicDisallowed"
+	ReasonExpiredProviderToken = "ExpiredProviderToken"
+	ReasonInvalidProviderToken = "InvalidProviderToken"
+)
+
+// http2ReasonToLegacyStatus maps a provider-API `reason` onto the
+// closest status byte from the legacy binary protocol (the same space
+// ApplePushResponses is keyed by), so that code listening on ErrChannel
+// sees a sensible status regardless of which Client type produced it.
+// Reasons with no legacy equivalent fall back to 255, "None (unknown)".
+func http2ReasonToLegacyStatus(reason string) uint8 {
+	switch reason {
+	case ReasonBadDeviceToken, ReasonUnregistered:
+		return 8 // Invalid token
+	case ReasonMissingTopic:
+		return 3 // Missing topic
+	case ReasonPayloadTooLarge:
+		return 7 // Invalid payload size
+	default:
+		return 255 // None (unknown)
+	}
+}
+
+// NewHTTP2Client builds an HTTP2Client authenticated with a TLS client
+// certificate, the same credentials accepted by NewClient.
+func NewHTTP2Client(gateway, certificateFile, keyFile string) (c *HTTP2Client) {
+	c = createHTTP2Client(gateway)
+	c.CertificateFile = certificateFile
+	c.KeyFile = keyFile
+	return
+}
+
+// BareHTTP2Client can be used to set the contents of your certificate
+// and key blocks manually.
+func BareHTTP2Client(gateway, certificateBase64, keyBase64 string) (c *HTTP2Client) {
+	c = createHTTP2Client(gateway)
+	c.CertificateBase64 = certificateBase64
+	c.KeyBase64 = keyBase64
+	return
+}
+
+// NewHTTP2ClientWithKey builds an HTTP2Client authenticated with a JWT
+// provider token, generated from the raw contents of a .p8 signing key
+// and refreshed automatically roughly every 50 minutes.
+func NewHTTP2ClientWithKey(gateway, keyID, teamID string, p8Key []byte) (c *HTTP2Client, err error) {
+	c = createHTTP2Client(gateway)
+	c.KeyID = keyID
+	c.TeamID = teamID
+
+	if c.signingKey, err = parseP8PrivateKey(p8Key); err != nil {
+		return nil, err
+	}
+
+	if err = c.refreshToken(); err != nil {
+		return nil, err
+	}
+
+	go c.refreshTokenLoop()
+	return c, nil
+}
+
+func createHTTP2Client(gateway string) (c *HTTP2Client) {
+	c = new(HTTP2Client)
+	c.Gateway = gateway
+	c.stop = make(chan struct{})
+	return
+}
+
+func parseP8PrivateKey(p8Key []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(p8Key)
+	if block == nil {
+		return nil, errors.New("apns: invalid .p8 key: no PEM block found")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("apns: invalid .p8 key: %w", err)
+	}
+
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("apns: .p8 key is not an ECDSA key")
+	}
+
+	return ecKey, nil
+}
+
+func (client *HTTP2Client) refreshTokenLoop() {
+	ticker := time.NewTicker(jwtRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := client.refreshToken(); err != nil {
+				ErrChannel <- &SendErr{Err: fmt.Errorf("apns: provider token refresh: %w", err)}
+			}
+		case <-client.stop:
+			return
+		}
+	}
+}
+
+// es256Sign builds a compact JWS (header.payload.signature, all
+// base64url-encoded) over the given header and claims, signed with
+// ES256 as required by Apple's provider token scheme. It avoids pulling
+// in a JWT dependency for what is otherwise three lines of JSON and a
+// signature.
+func es256Sign(header, claims map[string]interface{}, key *ecdsa.PrivateKey) (string, error) {
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." +
+		base64.RawURLEncoding.EncodeToString(claimsJSON)
+
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	// JOSE wants the raw, fixed-width r || s encoding, not ASN.1 DER.
+	const fieldSize = 32
+	sig := make([]byte, 2*fieldSize)
+	r.FillBytes(sig[0:fieldSize])
+	s.FillBytes(sig[fieldSize:])
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func (client *HTTP2Client) refreshToken() error {
+	now := time.Now()
+
+	signed, err := es256Sign(
+		map[string]interface{}{"alg": "ES256", "kid": client.KeyID},
+		map[string]interface{}{"iss": client.TeamID, "iat": now.Unix()},
+		client.signingKey,
+	)
+	if err != nil {
+		return err
+	}
+
+	client.mu.Lock()
+	client.token = signed
+	client.tokenIssued = now
+	client.mu.Unlock()
+	return nil
+}
+
+func (client *HTTP2Client) currentToken() string {
+	client.mu.RLock()
+	defer client.mu.RUnlock()
+	return client.token
+}
+
+// getCertificate returns a certificate to use for the HTTP/2 connection.
+// The certificate is only loaded once to save on the overhead of the
+// crypto libraries.
+func (client *HTTP2Client) getCertificate() error {
+	var err error
+
+	if client.certificate.PrivateKey == nil {
+		client.certificate, err = loadCertificate(client.CertificateFile, client.CertificateBase64, client.KeyFile, client.KeyBase64)
+	}
+
+	return err
+}
+
+func (client *HTTP2Client) httpClientFor() (*http.Client, error) {
+	client.mu.RLock()
+	hc := client.httpClient
+	client.mu.RUnlock()
+	if hc != nil {
+		return hc, nil
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.httpClient != nil {
+		return client.httpClient, nil
+	}
+
+	transport := &http.Transport{}
+	if client.signingKey == nil {
+		if err := client.getCertificate(); err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = &tls.Config{
+			Certificates: []tls.Certificate{client.certificate},
+		}
+	}
+
+	client.httpClient = &http.Client{Transport: transport, Timeout: TIME_OUT}
+	return client.httpClient, nil
+}
+
+type http2ErrorBody struct {
+	Reason    string `json:"reason"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+}
+
+// Send POSTs pn to Apple's provider API, translating the PushNotification
+// fields already used by the legacy protocol into the equivalent
+// `apns-*` headers, and returns a typed HTTP2Response describing the
+// outcome. Both a transport-level failure (with the error in SendErr.Err)
+// and a rejection by Apple (with an errResponse whose Status is the
+// closest legacy status) are also delivered on ErrChannel, so callers that
+// treat Client and HTTP2Client uniformly see errors in one place.
+func (client *HTTP2Client) Send(pn *PushNotification) (*HTTP2Response, error) {
+	httpClient, err := client.httpClientFor()
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := pn.PayloadJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	url := fmt.Sprintf("https://%s/3/device/%s", client.Gateway, pn.DeviceToken)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	if client.Topic != "" {
+		req.Header.Set("apns-topic", client.Topic)
+	}
+	req.Header.Set("apns-priority", strconv.Itoa(int(pn.Priority())))
+	if pn.Expiry != 0 {
+		req.Header.Set("apns-expiration", strconv.FormatUint(uint64(pn.Expiry), 10))
+	}
+	if client.CollapseID != "" {
+		req.Header.Set("apns-collapse-id", client.CollapseID)
+	}
+	if client.PushType != "" {
+		req.Header.Set("apns-push-type", client.PushType)
+	}
+	if tok := client.currentToken(); tok != "" {
+		req.Header.Set("authorization", "bearer "+tok)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		go func() {
+			ErrChannel <- &SendErr{Pn: pn, Res: nil, Err: err}
+		}()
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := &HTTP2Response{
+		StatusCode: resp.StatusCode,
+		ApnsID:     resp.Header.Get("apns-id"),
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var body http2ErrorBody
+		if err := json.NewDecoder(resp.Body).Decode(&body); err == nil {
+			result.Reason = body.Reason
+		}
+
+		go func() {
+			ErrChannel <- &SendErr{Pn: pn, Res: &errResponse{
+				Command:    ERR_RESPONSE_CMD,
+				Status:     http2ReasonToLegacyStatus(result.Reason),
+				Identifier: pn.Identifier,
+			}}
+		}()
+	}
+
+	return result, nil
+}
+
+// Shutdown stops the background provider-token refresh loop, if one is
+// running. It is safe to call on a certificate-authenticated client.
+func (client *HTTP2Client) Shutdown() {
+	select {
+	case <-client.stop:
+	default:
+		close(client.stop)
+	}
+}
@@ -0,0 +1,278 @@
+package apns
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+// PushClient is the subset of Client's behaviour callers depend on. It
+// exists so tests can substitute MockClient without talking to Apple.
+type PushClient interface {
+	Send(pn *PushNotification) error
+	Connect() error
+	Close()
+}
+
+var _ PushClient = (*Client)(nil)
+
+// MockClient implements PushClient by recording every notification
+// handed to Send instead of writing it anywhere. Tests can program
+// SendErr to make Send fail, and use DeliverErr to simulate an
+// asynchronous error response arriving from Apple.
+type MockClient struct {
+	mu         sync.Mutex
+	Sent       []*PushNotification
+	SendErr    error
+	ConnectErr error
+	Closed     bool
+}
+
+// NewMockClient returns a ready-to-use MockClient.
+func NewMockClient() *MockClient {
+	return &MockClient{}
+}
+
+// Send records pn and returns the canned SendErr, if one is set.
+func (m *MockClient) Send(pn *PushNotification) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.Sent = append(m.Sent, pn)
+	return m.SendErr
+}
+
+// Connect returns the canned ConnectErr, if one is set.
+func (m *MockClient) Connect() error {
+	return m.ConnectErr
+}
+
+// Close marks the mock as closed. Like Client.Close, it is safe to call
+// more than once.
+func (m *MockClient) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Closed = true
+}
+
+// SentCount returns how many notifications have been passed to Send.
+func (m *MockClient) SentCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.Sent)
+}
+
+// DeliverErr pushes a synthetic SendErr onto ErrChannel, as if Apple had
+// rejected pn with res, letting tests exercise code that listens on
+// ErrChannel without a real connection.
+func (m *MockClient) DeliverErr(pn *PushNotification, res *errResponse) {
+	ErrChannel <- &SendErr{Pn: pn, Res: res}
+}
+
+// TestServer is a minimal stand-in for Apple's gateway that speaks just
+// enough of the legacy binary protocol to drive end-to-end tests of
+// Client: it accepts the enhanced notification frame, and can be told to
+// reply with an error response after a chosen number of notifications,
+// mirroring the way Apple drops the connection after reporting an error.
+type TestServer struct {
+	Addr string
+
+	leaf     *x509.Certificate
+	listener net.Listener
+
+	mu         sync.Mutex
+	received   []*ReceivedFrame
+	failAt     int
+	failStatus uint8
+	failIdent  int32
+}
+
+// ReceivedFrame is one enhanced-format notification frame read off the
+// wire by a TestServer.
+type ReceivedFrame struct {
+	Identifier  int32
+	Expiry      uint32
+	DeviceToken string
+	Payload     []byte
+}
+
+// NewTestServer starts a TestServer on a loopback port with a freshly
+// generated self-signed certificate, and returns once it is ready to
+// accept connections.
+func NewTestServer() (*TestServer, error) {
+	cert, leaf, err := generateSelfSignedCert()
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ts := &TestServer{
+		Addr:     listener.Addr().String(),
+		leaf:     leaf,
+		listener: listener,
+		failAt:   -1,
+	}
+	go ts.serve()
+	return ts, nil
+}
+
+// CertPool returns an x509.CertPool trusting this server's self-signed
+// certificate, for use as a Client's RootCAs so it can dial the
+// TestServer without disabling certificate verification altogether.
+func (ts *TestServer) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.leaf)
+	return pool
+}
+
+// FailAt arranges for the (zero-indexed) position-th notification
+// received on a connection to be answered with an 8-byte error response
+// carrying status and identifier, after which the connection is closed,
+// matching Apple's own behaviour.
+func (ts *TestServer) FailAt(position int, status uint8, identifier int32) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.failAt = position
+	ts.failStatus = status
+	ts.failIdent = identifier
+}
+
+// Received returns every frame seen so far, across all connections.
+func (ts *TestServer) Received() []*ReceivedFrame {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	out := make([]*ReceivedFrame, len(ts.received))
+	copy(out, ts.received)
+	return out
+}
+
+// Close stops the server.
+func (ts *TestServer) Close() {
+	ts.listener.Close()
+}
+
+func (ts *TestServer) serve() {
+	for {
+		conn, err := ts.listener.Accept()
+		if err != nil {
+			return
+		}
+		go ts.handle(conn)
+	}
+}
+
+func (ts *TestServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	for seq := 0; ; seq++ {
+		frame, err := readNotificationFrame(conn)
+		if err != nil {
+			return
+		}
+
+		ts.mu.Lock()
+		ts.received = append(ts.received, frame)
+		shouldFail := seq == ts.failAt
+		status, identifier := ts.failStatus, ts.failIdent
+		ts.mu.Unlock()
+
+		if shouldFail {
+			resp := make([]byte, ERR_RESPONSE_LEN)
+			resp[0] = ERR_RESPONSE_CMD
+			resp[1] = status
+			binary.BigEndian.PutUint32(resp[2:], uint32(identifier))
+			conn.Write(resp)
+			return
+		}
+	}
+}
+
+// readNotificationFrame reads one enhanced-format notification: command
+// (1 byte, always 1), identifier (4 bytes), expiry (4 bytes), token
+// length + token, then payload length + payload.
+func readNotificationFrame(conn net.Conn) (*ReceivedFrame, error) {
+	header := make([]byte, 11)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[0] != 1 {
+		return nil, fmt.Errorf("apns: test server got unsupported command %d", header[0])
+	}
+
+	identifier := int32(binary.BigEndian.Uint32(header[1:5]))
+	expiry := binary.BigEndian.Uint32(header[5:9])
+	tokenLen := binary.BigEndian.Uint16(header[9:11])
+
+	token := make([]byte, tokenLen)
+	if _, err := io.ReadFull(conn, token); err != nil {
+		return nil, err
+	}
+
+	var payloadLenBuf [2]byte
+	if _, err := io.ReadFull(conn, payloadLenBuf[:]); err != nil {
+		return nil, err
+	}
+	payloadLen := binary.BigEndian.Uint16(payloadLenBuf[:])
+
+	payload := make([]byte, payloadLen)
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return nil, err
+	}
+
+	return &ReceivedFrame{
+		Identifier:  identifier,
+		Expiry:      expiry,
+		DeviceToken: hex.EncodeToString(token),
+		Payload:     payload,
+	}, nil
+}
+
+func generateSelfSignedCert() (tls.Certificate, *x509.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "apns test server"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, leaf, nil
+}
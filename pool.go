@@ -0,0 +1,101 @@
+package apns
+
+import "time"
+
+// poolWorkerBits is the number of high bits of every Identifier a Pool
+// reserves for the worker index, leaving the low bits for that worker's
+// own counter. 8 bits supports up to 256 workers, which is far more
+// than a single process needs.
+const (
+	poolWorkerBits  = 8
+	poolWorkerShift = 32 - poolWorkerBits
+)
+
+// Pool maintains a fixed number of independent Client workers, each
+// with its own TLS connection, sentQ and identifier namespace, so a
+// slow write on one worker no longer blocks every other caller of Send.
+type Pool struct {
+	workers []*Client
+	queue   chan *poolRequest
+	done    chan struct{}
+}
+
+type poolRequest struct {
+	pn     *PushNotification
+	result chan error
+}
+
+// NewClientPool starts size independent Client workers against gateway,
+// each authenticated with cert/key, and returns a Pool that spreads
+// Send calls across them via one shared buffered work queue: each request
+// goes to whichever worker is next free to take it, not to workers in a
+// fixed round-robin or hashed order.
+func NewClientPool(gateway, cert, key string, size int) *Pool {
+	return NewClientPoolWithOptions(gateway, cert, key, size, MAX_SEND_Q, TIME_OUT, 10)
+}
+
+// NewClientPoolWithOptions is like NewClientPool, but lets the caller
+// tune MaxSendQ, TimeOut and ErrChanCap for every worker in this Pool,
+// independently of any other Pool or Client in the same process.
+func NewClientPoolWithOptions(gateway, cert, key string, size, maxSendQ int, timeOut time.Duration, errChanCap int) *Pool {
+	p := &Pool{
+		workers: make([]*Client, size),
+		queue:   make(chan *poolRequest, size*64),
+		done:    make(chan struct{}),
+	}
+
+	for i := 0; i < size; i++ {
+		worker := create(gateway, maxSendQ, timeOut, errChanCap, noopStore{})
+		worker.CertificateFile = cert
+		worker.KeyFile = key
+		worker.workerIdent = int32(i) << poolWorkerShift
+		// Bound this worker's own counter to the low poolWorkerShift
+		// bits so it can never grow into the next worker's identifier
+		// namespace.
+		worker.counterBound = 1 << poolWorkerShift
+		p.workers[i] = worker
+
+		go p.run(worker)
+	}
+
+	return p
+}
+
+func (p *Pool) run(worker *Client) {
+	for {
+		select {
+		case req := <-p.queue:
+			req.result <- worker.Send(req.pn)
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// Send puts pn on the Pool's shared queue and blocks until a worker has
+// sent it, returning that worker's error. Requests leave the queue in
+// order, but with more than one worker they are written concurrently, so
+// notifications may reach Apple in a different order than Send was
+// called.
+func (p *Pool) Send(pn *PushNotification) error {
+	req := &poolRequest{pn: pn, result: make(chan error, 1)}
+	p.queue <- req
+	return <-req.result
+}
+
+// Close drains in-flight work and closes every worker's connection.
+func (p *Pool) Close() {
+	close(p.done)
+	for i := 0; ; i++ {
+		select {
+		case req := <-p.queue:
+			req.result <- p.workers[i%len(p.workers)].Send(req.pn)
+		default:
+			for _, worker := range p.workers {
+				worker.Close()
+			}
+			return
+		}
+	}
+}
+
@@ -0,0 +1,184 @@
+package apns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"io"
+	"os"
+	"sync"
+)
+
+// Store makes Client's send queue durable across restarts. Enqueue is
+// called before a notification is written to Apple and returns the
+// sequence number Client should later pass to AckThrough once Apple has
+// confirmed (or implicitly confirmed, by not rejecting) everything up
+// to and including it; LoadUnacked lets a fresh Client replay whatever
+// was still outstanding when the process last stopped. FileStore keys
+// seq by the notification's own Identifier, since that is already the
+// number Apple's error responses echo back and the one Client derives
+// the seq it passes to AckThrough from.
+type Store interface {
+	Enqueue(pn *PushNotification) (seq uint64, err error)
+	AckThrough(seq uint64) error
+	LoadUnacked() ([]*PushNotification, error)
+}
+
+// noopStore is the default Store used by NewClient and BareClient,
+// preserving the historical in-memory-only behaviour for callers that
+// don't need at-least-once delivery.
+type noopStore struct{}
+
+func (noopStore) Enqueue(pn *PushNotification) (uint64, error) { return 0, nil }
+func (noopStore) AckThrough(seq uint64) error                  { return nil }
+func (noopStore) LoadUnacked() ([]*PushNotification, error)    { return nil, nil }
+
+type storeRecordKind uint8
+
+const (
+	recordEnqueue storeRecordKind = iota
+	recordAck
+)
+
+type storeRecord struct {
+	Kind storeRecordKind
+	Seq  uint64
+	Pn   *PushNotification // only populated for recordEnqueue
+}
+
+// FileStore is the default durable Store: an append-only log of length-
+// prefixed gob-encoded enqueue and ack records. Each record is encoded
+// with its own gob.Encoder rather than one shared across the file,
+// because gob only writes a type's wire descriptor once per Encoder —
+// sharing an Encoder across process restarts (each opening a fresh
+// FileStore and appending to the same path) produces a file with more
+// than one type descriptor, which a single Decoder pass then refuses to
+// read. Framing each record independently keeps restarts composable.
+// LoadUnacked replays the whole log, which is fine for the size of
+// queue a single Client ever holds; it is not meant to be compacted
+// online, so long-running processes should recycle the file (e.g. on
+// deploy) once it grows inconveniently large.
+type FileStore struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// NewFileStore opens (or creates) the log at path.
+func NewFileStore(path string) (*FileStore, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileStore{
+		path: path,
+		file: file,
+	}, nil
+}
+
+// writeRecord appends rec to the log as a self-contained, length-
+// prefixed gob record.
+func (fs *FileStore) writeRecord(rec *storeRecord) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(rec); err != nil {
+		return err
+	}
+
+	var lenPrefix [4]byte
+	binary.BigEndian.PutUint32(lenPrefix[:], uint32(buf.Len()))
+	if _, err := fs.file.Write(lenPrefix[:]); err != nil {
+		return err
+	}
+	if _, err := fs.file.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return fs.file.Sync()
+}
+
+// Enqueue appends a durable record for pn, keyed by pn.Identifier so
+// that the seq AckThrough later receives can be derived straight from
+// an errResponse.
+func (fs *FileStore) Enqueue(pn *PushNotification) (uint64, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	seq := uint64(pn.Identifier)
+	if err := fs.writeRecord(&storeRecord{Kind: recordEnqueue, Seq: seq, Pn: pn}); err != nil {
+		return 0, err
+	}
+	return seq, nil
+}
+
+// AckThrough appends a record marking every enqueued notification up to
+// and including seq as delivered.
+func (fs *FileStore) AckThrough(seq uint64) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.writeRecord(&storeRecord{Kind: recordAck, Seq: seq})
+}
+
+// LoadUnacked replays the log and returns every enqueued notification
+// that has not yet been covered by an ack, in the order it was
+// originally enqueued.
+func (fs *FileStore) LoadUnacked() ([]*PushNotification, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	f, err := os.Open(fs.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pendingBySeq := make(map[uint64]*PushNotification)
+	var seqOrder []uint64
+
+	for {
+		var lenPrefix [4]byte
+		if _, err := io.ReadFull(f, lenPrefix[:]); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+
+		data := make([]byte, binary.BigEndian.Uint32(lenPrefix[:]))
+		if _, err := io.ReadFull(f, data); err != nil {
+			return nil, err
+		}
+
+		var rec storeRecord
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&rec); err != nil {
+			return nil, err
+		}
+
+		switch rec.Kind {
+		case recordEnqueue:
+			pendingBySeq[rec.Seq] = rec.Pn
+			seqOrder = append(seqOrder, rec.Seq)
+		case recordAck:
+			for seq := range pendingBySeq {
+				if seq <= rec.Seq {
+					delete(pendingBySeq, seq)
+				}
+			}
+		}
+	}
+
+	pending := make([]*PushNotification, 0, len(pendingBySeq))
+	for _, seq := range seqOrder {
+		if pn, ok := pendingBySeq[seq]; ok {
+			pending = append(pending, pn)
+		}
+	}
+	return pending, nil
+}
+
+// Close releases the underlying file handle.
+func (fs *FileStore) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.file.Close()
+}